@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// CredentialStore maps an appName to its bcrypt-hashed password, used to
+// authenticate SMTP AUTH attempts when Config.AuthRequired is set.
+type CredentialStore map[string]string
+
+// LoadCredentialStore reads a CredentialStore from a YAML or JSON file of
+// appName -> bcrypt(password) entries. The format is chosen by the file
+// extension, defaulting to YAML.
+func LoadCredentialStore(path string) (CredentialStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+
+	store := make(CredentialStore)
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &store)
+	} else {
+		err = yaml.Unmarshal(data, &store)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// Verify reports whether password matches the stored bcrypt hash for appName.
+func (c CredentialStore) Verify(appName, password string) bool {
+	hash, ok := c[appName]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// loginServer implements the LOGIN SASL mechanism (no RFC, see
+// draft-murchison-sasl-login) as a sasl.Server. go-sasl's LOGIN client always
+// sends the username as its initial response, but some clients wait to be
+// challenged for it, so Next tolerates either.
+type loginServer struct {
+	username     *string
+	authenticate func(username, password string) error
+}
+
+// Next implements sasl.Server.
+func (a *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.username == nil {
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		username := string(response)
+		a.username = &username
+		return []byte("Password:"), false, nil
+	}
+
+	err = a.authenticate(*a.username, string(response))
+	return nil, true, err
+}
@@ -0,0 +1,61 @@
+package main
+
+// Config holds the runtime configuration for the SMTP handler. It is built
+// from environment variables in main() and threaded through to the backend
+// so new settings don't grow StartSMTPServer's parameter list indefinitely.
+type Config struct {
+	SMTPPort        string
+	OrchestratorURL string
+	JWTToken        string
+
+	// TransportURLs is an ordered list of transport URLs to try for each
+	// outbound send, falling back to the next on failure. Supported
+	// schemes: https/http (Yundera orchestrator API, using JWTToken),
+	// smtp/smtps (conventional SMTP relay), exec (pipe to a local MTA).
+	// If empty, defaults to a single https transport built from
+	// OrchestratorURL.
+	TransportURLs []string
+
+	MaxAttachmentSize      int64
+	MaxTotalAttachmentSize int64
+
+	// RecipientTagDelimiter splits a recipient's local-part into an app
+	// identifier and an optional tag, e.g. "app+campaign@host" with
+	// delimiter "+" yields appName=app, tag=campaign.
+	RecipientTagDelimiter string
+	// DestinationMap optionally maps an appName to the real address the
+	// mail should be forwarded to. Recipients not present are forwarded
+	// unchanged.
+	DestinationMap map[string]string
+
+	// QueueDir is the spool directory for the durable outbound queue.
+	QueueDir string
+	// QueueWorkers is the number of goroutines draining the queue concurrently.
+	QueueWorkers int
+	// QueueMaxAttempts caps how many times delivery of a queued email is
+	// retried before it's moved to the dead-letter directory.
+	QueueMaxAttempts int
+
+	// AuthRequired enforces SMTP AUTH against Credentials; if false (the
+	// default), any PLAIN/LOGIN credentials are accepted, matching the
+	// handler's original private-network-only posture.
+	AuthRequired bool
+	// Credentials is the appName -> bcrypt(password) store checked when
+	// AuthRequired is set.
+	Credentials CredentialStore
+
+	// TLSCertFile and TLSKeyFile, if both set, enable STARTTLS on the plain
+	// listener and are reused for the implicit-TLS listener on SMTPSPort.
+	TLSCertFile string
+	TLSKeyFile  string
+	// SMTPSPort, if set, starts an additional listener that requires TLS
+	// from the first byte, instead of negotiating it via STARTTLS.
+	SMTPSPort string
+
+	// MetricsAddr, if set, starts an admin HTTP server on this address
+	// exposing /metrics, /healthz and /readyz. If empty, none of them run.
+	MetricsAddr string
+	// MetricsMaxAppLabels caps the number of distinct appName label values
+	// tracked per metric before folding the rest into "other".
+	MetricsMaxAppLabels int
+}
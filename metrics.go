@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultMetricsMaxAppLabels caps the number of distinct appName label
+// values a metric will track before folding additional apps into "other",
+// so a burst of bogus or spoofed appNames can't blow up Prometheus
+// cardinality.
+const DefaultMetricsMaxAppLabels = 50
+
+// orchestratorCheckInterval is how often the orchestrator reachability
+// check backing /healthz and /readyz runs.
+const orchestratorCheckInterval = 30 * time.Second
+
+// Metrics holds the handler's Prometheus collectors. Per-appName labels are
+// capped at maxAppLabels distinct values; beyond that, appName is reported
+// as "other".
+type Metrics struct {
+	registry *prometheus.Registry
+
+	connectionsAccepted   prometheus.Counter
+	authenticatedSessions prometheus.Counter
+	messagesReceived      *prometheus.CounterVec
+	bytesReceived         *prometheus.CounterVec
+	parseFailures         prometheus.Counter
+	forwardDuration       *prometheus.HistogramVec
+	forwardResults        *prometheus.CounterVec
+
+	maxAppLabels int
+	appLabelsMu  sync.Mutex
+	seenApps     map[string]struct{}
+
+	// orchestratorCheckEnabled is set when an HTTP(S) transport is actually
+	// configured; orchestrator-free deployments (SMTP relay, exec) have
+	// nothing to probe, so OrchestratorReachable reports healthy regardless.
+	orchestratorCheckEnabled int32 // atomic bool
+	lastOrchestratorOK       int64 // unix seconds, atomic; 0 = never succeeded
+}
+
+// NewMetrics creates a Metrics registry. maxAppLabels defaults to
+// DefaultMetricsMaxAppLabels if zero or negative.
+func NewMetrics(maxAppLabels int) *Metrics {
+	if maxAppLabels <= 0 {
+		maxAppLabels = DefaultMetricsMaxAppLabels
+	}
+
+	m := &Metrics{
+		registry:     prometheus.NewRegistry(),
+		maxAppLabels: maxAppLabels,
+		seenApps:     make(map[string]struct{}),
+
+		connectionsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smtp_connections_accepted_total",
+			Help: "Total number of SMTP connections accepted.",
+		}),
+		authenticatedSessions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smtp_authenticated_sessions_total",
+			Help: "Total number of sessions that completed SMTP AUTH successfully.",
+		}),
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smtp_messages_received_total",
+			Help: "Total number of email messages received, by app.",
+		}, []string{"app"}),
+		bytesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smtp_bytes_received_total",
+			Help: "Total bytes of raw email data received, by app.",
+		}, []string{"app"}),
+		parseFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smtp_parse_failures_total",
+			Help: "Total number of messages that failed MIME parsing.",
+		}),
+		forwardDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smtp_forward_duration_seconds",
+			Help:    "Time to forward a message to its transport(s), by app.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"app"}),
+		// "result" is success/failure rather than an HTTP status: forwarding
+		// now goes through the pluggable Transport interface (HTTP, SMTP
+		// relay, exec), and only the HTTP transport has a status code.
+		// Per-transport failure detail is in the forward logs.
+		forwardResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smtp_forward_total",
+			Help: "Total forward attempts, by app and result (success/failure).",
+		}, []string{"app", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.connectionsAccepted,
+		m.authenticatedSessions,
+		m.messagesReceived,
+		m.bytesReceived,
+		m.parseFailures,
+		m.forwardDuration,
+		m.forwardResults,
+	)
+
+	return m
+}
+
+// RegisterQueueCollectors wires gauges/counters backed by queue's own atomic
+// counters into m. Called once the outbound queue exists.
+func (m *Metrics) RegisterQueueCollectors(queue *OutboundQueue) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "smtp_queue_depth",
+			Help: "Number of emails currently spooled awaiting delivery.",
+		}, func() float64 { return float64(queue.Depth()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "smtp_queue_retry_attempts_total",
+			Help: "Total number of delivery retry attempts.",
+		}, func() float64 { return float64(queue.RetryCount()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "smtp_queue_dead_letter_size",
+			Help: "Number of emails moved to the dead-letter directory.",
+		}, func() float64 { return float64(queue.DeadLetterSize()) }),
+	)
+}
+
+// appLabel returns appName as a metric label value, capping the number of
+// distinct values tracked across the process lifetime at maxAppLabels.
+func (m *Metrics) appLabel(appName string) string {
+	m.appLabelsMu.Lock()
+	defer m.appLabelsMu.Unlock()
+
+	if _, ok := m.seenApps[appName]; ok {
+		return appName
+	}
+	if len(m.seenApps) >= m.maxAppLabels {
+		return "other"
+	}
+	m.seenApps[appName] = struct{}{}
+	return appName
+}
+
+// RecordConnectionAccepted increments the accepted-connections counter.
+func (m *Metrics) RecordConnectionAccepted() {
+	m.connectionsAccepted.Inc()
+}
+
+// RecordAuthenticatedSession increments the authenticated-sessions counter.
+func (m *Metrics) RecordAuthenticatedSession() {
+	m.authenticatedSessions.Inc()
+}
+
+// RecordMessageReceived records a received message's size against appName.
+func (m *Metrics) RecordMessageReceived(appName string, bytes int) {
+	label := m.appLabel(appName)
+	m.messagesReceived.WithLabelValues(label).Inc()
+	m.bytesReceived.WithLabelValues(label).Add(float64(bytes))
+}
+
+// RecordParseFailure increments the parse-failures counter.
+func (m *Metrics) RecordParseFailure() {
+	m.parseFailures.Inc()
+}
+
+// RecordForward records the outcome and duration of a forward attempt for
+// appName.
+func (m *Metrics) RecordForward(appName string, duration time.Duration, err error) {
+	label := m.appLabel(appName)
+	m.forwardDuration.WithLabelValues(label).Observe(duration.Seconds())
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.forwardResults.WithLabelValues(label, result).Inc()
+}
+
+// RecordOrchestratorCheck records the outcome of an orchestrator
+// reachability check, backing OrchestratorReachable.
+func (m *Metrics) RecordOrchestratorCheck(ok bool) {
+	if ok {
+		atomic.StoreInt64(&m.lastOrchestratorOK, time.Now().Unix())
+	}
+}
+
+// OrchestratorReachable reports whether the orchestrator answered within the
+// last two check intervals. If no HTTP(S) transport is configured, there's
+// nothing to probe and this always reports healthy.
+func (m *Metrics) OrchestratorReachable() bool {
+	if atomic.LoadInt32(&m.orchestratorCheckEnabled) == 0 {
+		return true
+	}
+	last := atomic.LoadInt64(&m.lastOrchestratorOK)
+	if last == 0 {
+		return false
+	}
+	return time.Since(time.Unix(last, 0)) < 2*orchestratorCheckInterval
+}
+
+// startOrchestratorChecker periodically probes orchestratorURL and records
+// the result into metrics, until stopCh is closed. Only call this when an
+// HTTP(S) transport is actually configured; it enables the reachability
+// check that /healthz and /readyz gate on.
+func startOrchestratorChecker(orchestratorURL string, metrics *Metrics, stopCh <-chan struct{}) {
+	atomic.StoreInt32(&metrics.orchestratorCheckEnabled, 1)
+	client := &http.Client{Timeout: 5 * time.Second}
+	check := func() {
+		resp, err := client.Get(orchestratorURL)
+		if err != nil {
+			metrics.RecordOrchestratorCheck(false)
+			return
+		}
+		resp.Body.Close()
+		metrics.RecordOrchestratorCheck(true)
+	}
+
+	go func() {
+		check()
+		ticker := time.NewTicker(orchestratorCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
+
+// countingListener wraps a net.Listener to record each accepted connection.
+type countingListener struct {
+	net.Listener
+	metrics *Metrics
+}
+
+// Accept implements net.Listener.
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.metrics.RecordConnectionAccepted()
+	}
+	return conn, err
+}
+
+// StartMetricsServer starts the admin HTTP server exposing /metrics,
+// /healthz and /readyz on cfg.MetricsAddr. If cfg.MetricsAddr is empty, it
+// is a no-op and returns a nil *http.Server.
+func StartMetricsServer(cfg Config, metrics *Metrics, queue *OutboundQueue) (*http.Server, error) {
+	if cfg.MetricsAddr == "" {
+		return nil, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !metrics.OrchestratorReachable() {
+			http.Error(w, "orchestrator unreachable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !metrics.OrchestratorReachable() || !queue.Healthy() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	ln, err := net.Listen("tcp", cfg.MetricsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on metrics address %s: %w", cfg.MetricsAddr, err)
+	}
+
+	server := &http.Server{Addr: cfg.MetricsAddr, Handler: mux}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics server error: %v", err)
+		}
+	}()
+
+	log.Printf("✓ Metrics server started on %s (/metrics, /healthz, /readyz)", cfg.MetricsAddr)
+	return server, nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// DefaultQueueWorkers is the default number of goroutines draining the
+// outbound queue concurrently.
+const DefaultQueueWorkers = 4
+
+// queueBackoffSchedule is the delay before each retry after a failed send.
+var queueBackoffSchedule = []time.Duration{
+	1 * time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	5 * time.Minute,
+	1 * time.Hour,
+}
+
+// DefaultQueueMaxAttempts is the default number of send attempts (including
+// the first) before an item is moved to the dead-letter directory.
+var DefaultQueueMaxAttempts = len(queueBackoffSchedule) + 1
+
+// pollInterval is how often idle workers re-scan the spool directory.
+const pollInterval = 500 * time.Millisecond
+
+// sendFunc delivers a parsed EmailRequest, and the raw MIME message it was
+// parsed from, to its destination.
+type sendFunc func(ctx context.Context, req EmailRequest, rawMIME []byte) error
+
+// spoolItem is the JSON payload persisted for each queued email. RawMIME is
+// base64-encoded, like Attachment.Content, since it's binary-safe text data.
+type spoolItem struct {
+	ID          string       `json:"id"`
+	Request     EmailRequest `json:"request"`
+	RawMIME     string       `json:"rawMime,omitempty"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"nextAttempt,omitempty"`
+	LastError   string       `json:"lastError,omitempty"`
+}
+
+// OutboundQueue is a durable, append-only JSON spool directory that
+// decouples accepting an email over SMTP from forwarding it to its
+// destination. Enqueue writes and fsyncs a spool file and returns
+// immediately; a pool of worker goroutines drains the directory in the
+// background, retrying failed sends with exponential backoff and moving
+// permanently failed items to a dead-letter directory.
+type OutboundQueue struct {
+	spoolDir      string
+	deadLetterDir string
+	maxAttempts   int
+	send          sendFunc
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	depth      int64 // atomic: items currently spooled, awaiting send
+	retryCount int64 // atomic: total retry attempts across the queue's lifetime
+}
+
+// NewOutboundQueue creates the spool and dead-letter directories if needed
+// and starts workers workers draining spoolDir, delivering items with send.
+func NewOutboundQueue(spoolDir string, workers, maxAttempts int, send sendFunc) (*OutboundQueue, error) {
+	if workers <= 0 {
+		workers = DefaultQueueWorkers
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultQueueMaxAttempts
+	}
+
+	deadLetterDir := filepath.Join(spoolDir, "dead-letter")
+	if err := os.MkdirAll(deadLetterDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory: %w", err)
+	}
+
+	q := &OutboundQueue{
+		spoolDir:      spoolDir,
+		deadLetterDir: deadLetterDir,
+		maxAttempts:   maxAttempts,
+		send:          send,
+		stopCh:        make(chan struct{}),
+	}
+
+	if err := q.recoverOrphans(); err != nil {
+		return nil, fmt.Errorf("failed to recover orphaned spool items: %w", err)
+	}
+
+	q.depth = int64(len(q.listSpoolFiles()))
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.run()
+	}
+
+	return q, nil
+}
+
+// Enqueue persists req and its raw MIME source to the spool directory and
+// returns once the write is fsynced. A worker picks it up and delivers it
+// asynchronously.
+func (q *OutboundQueue) Enqueue(req EmailRequest, rawMIME []byte) error {
+	item := spoolItem{
+		ID:      ulid.Make().String(),
+		Request: req,
+		RawMIME: base64.StdEncoding.EncodeToString(rawMIME),
+	}
+	if err := q.writeSpoolFile(filepath.Join(q.spoolDir, item.ID+".json"), item); err != nil {
+		return fmt.Errorf("failed to enqueue email: %w", err)
+	}
+	atomic.AddInt64(&q.depth, 1)
+	return nil
+}
+
+// Depth returns the approximate number of items awaiting delivery.
+func (q *OutboundQueue) Depth() int64 {
+	return atomic.LoadInt64(&q.depth)
+}
+
+// RetryCount returns the total number of retry attempts made so far.
+func (q *OutboundQueue) RetryCount() int64 {
+	return atomic.LoadInt64(&q.retryCount)
+}
+
+// DeadLetterSize returns the number of emails moved to the dead-letter
+// directory after exhausting their retries.
+func (q *OutboundQueue) DeadLetterSize() int64 {
+	entries, err := os.ReadDir(q.deadLetterDir)
+	if err != nil {
+		return 0
+	}
+	var n int64
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".json" {
+			n++
+		}
+	}
+	return n
+}
+
+// Healthy reports whether the queue is still draining, i.e. Shutdown hasn't
+// been called.
+func (q *OutboundQueue) Healthy() bool {
+	select {
+	case <-q.stopCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// Shutdown signals workers to stop after their current in-flight send
+// finishes, and waits for them or for ctx to expire.
+func (q *OutboundQueue) Shutdown(ctx context.Context) error {
+	close(q.stopCh)
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DrainAndWait processes the spool until it is empty or ctx expires,
+// ignoring each item's backoff delay so a single backed-off item doesn't
+// idle-wait out its retry schedule. NewOutboundQueue has already started the
+// queue's own worker goroutines by the time --drain calls this, so the two
+// compete for claims via the same atomic rename; that's safe, just redundant
+// once the spool is empty.
+func (q *OutboundQueue) DrainAndWait(ctx context.Context) error {
+	for {
+		if q.processNext(true) {
+			continue
+		}
+		if len(q.listSpoolFiles()) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// run is a worker's main loop: poll the spool directory, process one ready
+// item at a time, until told to stop.
+func (q *OutboundQueue) run() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stopCh:
+			return
+		case <-ticker.C:
+			q.processNext(false)
+		}
+	}
+}
+
+// processNext claims and delivers the oldest ready spool item, if any.
+// Returns true if it did work. If force is set, an item's backoff delay
+// (NextAttempt) is ignored instead of skipping it.
+func (q *OutboundQueue) processNext(force bool) bool {
+	now := time.Now()
+	for _, name := range q.listSpoolFiles() {
+		path := filepath.Join(q.spoolDir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // picked up by another worker, or removed
+		}
+
+		var item spoolItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			log.Printf("Dropping unreadable spool file %s: %v", name, err)
+			os.Remove(path)
+			atomic.AddInt64(&q.depth, -1)
+			continue
+		}
+		if !force && item.NextAttempt.After(now) {
+			continue
+		}
+
+		lockPath := path + ".processing"
+		if err := os.Rename(path, lockPath); err != nil {
+			continue // another worker claimed it first
+		}
+
+		q.processItem(lockPath, item)
+		return true
+	}
+	return false
+}
+
+// processItem attempts delivery of item (claimed at lockPath) and either
+// removes it, reschedules it with backoff, or moves it to the dead-letter
+// directory once maxAttempts is exhausted.
+func (q *OutboundQueue) processItem(lockPath string, item spoolItem) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rawMIME, decodeErr := base64.StdEncoding.DecodeString(item.RawMIME)
+	if decodeErr != nil {
+		log.Printf("Dropping email %s: corrupt raw MIME in spool: %v", item.ID, decodeErr)
+		os.Remove(lockPath)
+		atomic.AddInt64(&q.depth, -1)
+		return
+	}
+
+	err := q.send(ctx, item.Request, rawMIME)
+	if err == nil {
+		os.Remove(lockPath)
+		atomic.AddInt64(&q.depth, -1)
+		return
+	}
+
+	atomic.AddInt64(&q.retryCount, 1)
+	item.Attempts++
+	item.LastError = err.Error()
+
+	if item.Attempts >= q.maxAttempts {
+		log.Printf("Moving email %s to dead-letter after %d attempts: %v", item.ID, item.Attempts, err)
+		if werr := q.writeSpoolFile(filepath.Join(q.deadLetterDir, item.ID+".json"), item); werr != nil {
+			log.Printf("Failed to write dead-letter file for %s: %v", item.ID, werr)
+		}
+		os.Remove(lockPath)
+		atomic.AddInt64(&q.depth, -1)
+		return
+	}
+
+	backoffIdx := item.Attempts - 1
+	if backoffIdx >= len(queueBackoffSchedule) {
+		backoffIdx = len(queueBackoffSchedule) - 1
+	}
+	backoff := queueBackoffSchedule[backoffIdx]
+	item.NextAttempt = time.Now().Add(backoff)
+	log.Printf("Retrying email %s in %s (attempt %d/%d): %v", item.ID, backoff, item.Attempts, q.maxAttempts, err)
+	if werr := q.writeSpoolFile(filepath.Join(q.spoolDir, item.ID+".json"), item); werr != nil {
+		log.Printf("Failed to requeue email %s: %v", item.ID, werr)
+	}
+	os.Remove(lockPath)
+}
+
+// recoverOrphans renames any "*.json.processing" files left behind by a
+// worker that was claiming an item when the process crashed or was killed
+// back to "*.json", so they're picked up again instead of being silently
+// lost (listSpoolFiles only ever looks at "*.json").
+func (q *OutboundQueue) recoverOrphans() error {
+	entries, err := os.ReadDir(q.spoolDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json.processing") {
+			continue
+		}
+		lockPath := filepath.Join(q.spoolDir, e.Name())
+		path := strings.TrimSuffix(lockPath, ".processing")
+		log.Printf("Recovering orphaned spool item %s", e.Name())
+		if err := os.Rename(lockPath, path); err != nil {
+			return fmt.Errorf("failed to recover %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// listSpoolFiles returns the spool directory's *.json filenames, sorted
+// ascending. ULID filenames sort chronologically, so this is oldest-first.
+func (q *OutboundQueue) listSpoolFiles() []string {
+	entries, err := os.ReadDir(q.spoolDir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeSpoolFile marshals item and writes it to path via a temp-file-then-
+// rename so a worker never observes a partially written file, fsyncing
+// both the file and its parent directory.
+func (q *OutboundQueue) writeSpoolFile(path string, item spoolItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestQueue creates an OutboundQueue rooted at a fresh temp directory,
+// with a single worker so processing order is deterministic.
+func newTestQueue(t *testing.T, maxAttempts int, send sendFunc) *OutboundQueue {
+	t.Helper()
+	q, err := NewOutboundQueue(t.TempDir(), 1, maxAttempts, send)
+	if err != nil {
+		t.Fatalf("NewOutboundQueue: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		q.Shutdown(ctx)
+	})
+	return q
+}
+
+// TestOutboundQueueRoundTrip enqueues an email and verifies a worker
+// delivers it, removing it from the spool.
+func TestOutboundQueueRoundTrip(t *testing.T) {
+	delivered := make(chan EmailRequest, 1)
+	q := newTestQueue(t, DefaultQueueMaxAttempts, func(ctx context.Context, req EmailRequest, rawMIME []byte) error {
+		delivered <- req
+		return nil
+	})
+
+	req := EmailRequest{AppName: "billing", To: "billing@example.com"}
+	if err := q.Enqueue(req, []byte("raw mime")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if got := q.Depth(); got != 1 {
+		t.Fatalf("Depth() after enqueue = %d, want 1", got)
+	}
+
+	select {
+	case got := <-delivered:
+		if got.AppName != req.AppName {
+			t.Fatalf("delivered AppName = %q, want %q", got.AppName, req.AppName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Depth() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Depth() did not return to 0 after delivery, still %d", q.Depth())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestOutboundQueueRetryAndDeadLetter forces every send attempt to fail and
+// verifies the item is retried maxAttempts-1 times, with backoff clamped to
+// the schedule's shortest delay, before landing in the dead-letter directory.
+func TestOutboundQueueRetryAndDeadLetter(t *testing.T) {
+	origSchedule := queueBackoffSchedule
+	queueBackoffSchedule = []time.Duration{time.Millisecond}
+	t.Cleanup(func() { queueBackoffSchedule = origSchedule })
+
+	const maxAttempts = 3
+	var attempts int32
+	q := newTestQueue(t, maxAttempts, func(ctx context.Context, req EmailRequest, rawMIME []byte) error {
+		atomic.AddInt32(&attempts, 1)
+		return errors.New("destination unreachable")
+	})
+
+	if err := q.Enqueue(EmailRequest{AppName: "billing"}, []byte("raw mime")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for q.DeadLetterSize() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("item never reached dead-letter; attempts=%d, depth=%d", atomic.LoadInt32(&attempts), q.Depth())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != maxAttempts {
+		t.Fatalf("send called %d times, want %d", got, maxAttempts)
+	}
+	if got := q.RetryCount(); got != maxAttempts {
+		t.Fatalf("RetryCount() = %d, want %d", got, maxAttempts)
+	}
+	if got := q.DeadLetterSize(); got != 1 {
+		t.Fatalf("DeadLetterSize() = %d, want 1", got)
+	}
+	if got := q.Depth(); got != 0 {
+		t.Fatalf("Depth() = %d, want 0 once dead-lettered", got)
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -22,21 +22,46 @@ import (
 
 const (
 	MaxEmailSize = 10 * 1024 * 1024 // 10MB
+
+	// DefaultMaxAttachmentSize is the default per-attachment size cap.
+	DefaultMaxAttachmentSize = 5 * 1024 * 1024 // 5MB
+	// DefaultMaxTotalAttachmentSize is the default cap on the combined size
+	// of all attachments in a single message.
+	DefaultMaxTotalAttachmentSize = 20 * 1024 * 1024 // 20MB
+
+	// DefaultQueueDir is the default spool directory for the outbound queue.
+	DefaultQueueDir = "./data/outbox"
 )
 
-// EmailRequest represents the request to Yundera email API
+// EmailRequest represents a parsed email, forwarded to the configured
+// Transport(s).
 type EmailRequest struct {
-	To      string `json:"to"`
-	Subject string `json:"subject"`
-	Text    string `json:"text"`
-	HTML    string `json:"html,omitempty"`
-	AppName string `json:"appName"`
+	From        string       `json:"from,omitempty"`
+	To          string       `json:"to"`
+	Subject     string       `json:"subject"`
+	Text        string       `json:"text"`
+	HTML        string       `json:"html,omitempty"`
+	AppName     string       `json:"appName"`
+	Tag         string       `json:"tag,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Attachment represents a file attached to an email, base64-encoded for
+// transport in the JSON request body.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Content     string `json:"content"` // base64-encoded
+	Size        int    `json:"size"`
 }
 
 // SMTPBackend implements SMTP server backend
 type SMTPBackend struct {
-	jwtToken        string
-	orchestratorURL string
+	cfg           Config
+	queue         *OutboundQueue
+	metrics       *Metrics
+	metricsServer *http.Server
+	healthStopCh  chan struct{}
 }
 
 // SMTPSession represents an SMTP session
@@ -48,12 +73,68 @@ type SMTPSession struct {
 	authUser string
 }
 
-// NewSMTPBackend creates a new SMTP backend
-func NewSMTPBackend(orchestratorURL, jwtToken string) *SMTPBackend {
-	return &SMTPBackend{
-		orchestratorURL: orchestratorURL,
-		jwtToken:        jwtToken,
+// NewSMTPBackend creates a new SMTP backend, builds its transport chain, and
+// starts its outbound queue.
+func NewSMTPBackend(cfg Config) (*SMTPBackend, error) {
+	metrics := NewMetrics(cfg.MetricsMaxAppLabels)
+	b := &SMTPBackend{cfg: cfg, metrics: metrics, healthStopCh: make(chan struct{})}
+
+	transportURLs := cfg.TransportURLs
+	if len(transportURLs) == 0 {
+		transportURLs = []string{cfg.OrchestratorURL}
+	}
+
+	transports := make([]Transport, 0, len(transportURLs))
+	hasHTTPTransport := false
+	for _, rawURL := range transportURLs {
+		t, err := BuildTransport(rawURL, cfg.JWTToken)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transport %q: %w", rawURL, err)
+		}
+		if _, ok := t.(*httpTransport); ok {
+			hasHTTPTransport = true
+		}
+		transports = append(transports, t)
+	}
+	fallback := &FallbackTransport{transports: transports}
+
+	send := func(ctx context.Context, req EmailRequest, rawMIME []byte) error {
+		start := time.Now()
+		err := fallback.Send(ctx, req, rawMIME)
+		metrics.RecordForward(req.AppName, time.Since(start), err)
+		return err
+	}
+
+	queue, err := NewOutboundQueue(cfg.QueueDir, cfg.QueueWorkers, cfg.QueueMaxAttempts, send)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start outbound queue: %w", err)
+	}
+	b.queue = queue
+	metrics.RegisterQueueCollectors(queue)
+
+	if hasHTTPTransport {
+		startOrchestratorChecker(cfg.OrchestratorURL, metrics, b.healthStopCh)
+	}
+
+	if metricsServer, err := StartMetricsServer(cfg, metrics, queue); err != nil {
+		return nil, err
+	} else {
+		b.metricsServer = metricsServer
+	}
+
+	return b, nil
+}
+
+// Shutdown gracefully stops the backend's outbound queue and metrics server,
+// waiting for any in-flight send to finish or ctx to expire.
+func (b *SMTPBackend) Shutdown(ctx context.Context) error {
+	close(b.healthStopCh)
+	if b.metricsServer != nil {
+		if err := b.metricsServer.Shutdown(ctx); err != nil {
+			log.Printf("Metrics server did not shut down cleanly: %v", err)
+		}
 	}
+	return b.queue.Shutdown(ctx)
 }
 
 // NewSession creates a new SMTP session
@@ -63,22 +144,43 @@ func (b *SMTPBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	}, nil
 }
 
-// AuthMechanisms returns supported authentication mechanisms
+// AuthMechanisms returns supported authentication mechanisms. CRAM-MD5 is
+// deliberately not supported: it requires the server to reproduce
+// HMAC-MD5(password, challenge) to check the client's response, which a
+// bcrypt hash makes impossible.
 func (s *SMTPSession) AuthMechanisms() []string {
-	return []string{sasl.Plain}
+	return []string{sasl.Plain, sasl.Login}
 }
 
-// Auth creates a SASL server for authentication
-// NOTE: Authentication is relaxed since this runs in a private Docker network
-// Apps can connect without credentials since network isolation provides security
+// Auth creates a SASL server for authentication. If cfg.AuthRequired is set,
+// credentials are verified against cfg.Credentials and a failed check rejects
+// the session; otherwise (the handler's original behavior) any credentials
+// are accepted, since network isolation is assumed to be the security
+// boundary.
 func (s *SMTPSession) Auth(mech string) (sasl.Server, error) {
-	return sasl.NewPlainServer(func(identity, username, password string) error {
-		// Accept any credentials - network isolation is the security boundary
+	authenticate := func(username, password string) error {
+		cfg := s.backend.cfg
+		if cfg.AuthRequired && !cfg.Credentials.Verify(username, password) {
+			log.Printf("SMTP AUTH rejected for app: %s", username)
+			return errors.New("invalid credentials")
+		}
 		log.Printf("SMTP connection from app: %s", username)
 		s.authUser = username
 		s.appName = sanitizeAppName(username)
+		s.backend.metrics.RecordAuthenticatedSession()
 		return nil
-	}), nil
+	}
+
+	switch mech {
+	case sasl.Login:
+		return &loginServer{authenticate: authenticate}, nil
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return authenticate(username, password)
+		}), nil
+	default:
+		return nil, errors.New("unsupported SASL mechanism")
+	}
 }
 
 // Mail sets the sender
@@ -102,39 +204,74 @@ func (s *SMTPSession) Data(r io.Reader) error {
 	}
 
 	// Parse email
-	subject, text, html := parseEmail(string(data))
+	subject, text, html, attachments, parseFailed := parseEmail(string(data), s.backend.cfg.MaxAttachmentSize, s.backend.cfg.MaxTotalAttachmentSize)
+	if parseFailed {
+		s.backend.metrics.RecordParseFailure()
+	}
 
 	// Get first recipient
 	if len(s.to) == 0 {
 		return fmt.Errorf("no recipients specified")
 	}
 	recipientEmail := s.to[0]
+	route, hasRoute := parseRecipientRoute(recipientEmail, s.backend.cfg.RecipientTagDelimiter)
 
-	// Determine app name from authentication or sender
+	// Determine app name with three-tier precedence: AUTH, then recipient
+	// routing, then the sender address. The tag is always taken from the
+	// recipient route when present, independent of how appName was resolved.
 	appName := s.appName
-	if appName == "" {
-		// Try to extract app name from sender address
-		if s.from != "" {
-			parts := strings.Split(s.from, "@")
-			if len(parts) > 0 {
-				appName = sanitizeAppName(parts[0])
-			}
+	var tag string
+	if hasRoute {
+		tag = route.Tag
+	}
+	if appName == "" && hasRoute {
+		appName = route.AppName
+	}
+	if appName == "" && s.from != "" {
+		parts := strings.Split(s.from, "@")
+		if len(parts) > 0 {
+			appName = sanitizeAppName(parts[0])
 		}
 	}
 	if appName == "" {
 		appName = "app"
 	}
 
-	log.Printf("Processing email from app '%s' to %s", appName, recipientEmail)
+	// Resolve the recipient's real destination, if one is configured. This is
+	// keyed off the recipient route's app, not the resolved appName, so an
+	// authenticated sender can still fan out to multiple downstream services
+	// over one connection by varying the recipient address.
+	destinationKey := appName
+	if hasRoute {
+		destinationKey = route.AppName
+	}
+	destination := recipientEmail
+	if dest, ok := s.backend.cfg.DestinationMap[destinationKey]; ok {
+		destination = dest
+	}
+
+	s.backend.metrics.RecordMessageReceived(appName, len(data))
+	log.Printf("Processing email from app '%s' (tag=%q) to %s", appName, tag, destination)
 
-	// Forward to Yundera Email API
-	err = s.forwardToAPI(recipientEmail, subject, text, html, appName)
-	if err != nil {
-		log.Printf("Failed to forward email to API: %v", err)
+	// Enqueue for asynchronous delivery. The outbound queue persists the
+	// request before this returns, so a transient orchestrator outage
+	// doesn't bounce the mail back to the sending app.
+	emailReq := EmailRequest{
+		From:        s.from,
+		To:          destination,
+		Subject:     subject,
+		Text:        text,
+		HTML:        html,
+		AppName:     appName,
+		Tag:         tag,
+		Attachments: attachments,
+	}
+	if err := s.backend.queue.Enqueue(emailReq, data); err != nil {
+		log.Printf("Failed to enqueue email: %v", err)
 		return err
 	}
 
-	log.Printf("Email forwarded successfully from %s", appName)
+	log.Printf("Email queued for delivery from %s", appName)
 	return nil
 }
 
@@ -149,76 +286,74 @@ func (s *SMTPSession) Logout() error {
 	return nil
 }
 
-// forwardToAPI sends the email to Yundera Email API via HTTP
-func (s *SMTPSession) forwardToAPI(recipientEmail, subject, text, html, appName string) error {
-	// Create email request
-	emailReq := EmailRequest{
-		To:      recipientEmail,
-		Subject: subject,
-		Text:    text,
-		HTML:    html,
-		AppName: appName,
-	}
+// identifierPattern matches characters disallowed in an app name or tag.
+var identifierPattern = regexp.MustCompile("[^a-z0-9-]")
 
-	// Marshal to JSON
-	jsonData, err := json.Marshal(emailReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal email request: %w", err)
+// sanitizeIdentifier restricts name to lowercase alphanumerics and hyphens,
+// capped at 20 characters, without substituting a fallback for an empty result.
+func sanitizeIdentifier(name string) string {
+	name = strings.ToLower(name)
+	name = identifierPattern.ReplaceAllString(name, "")
+	if len(name) > 20 {
+		name = name[:20]
 	}
+	return name
+}
 
-	// Create HTTP request
-	url := fmt.Sprintf("%s/email/send", s.backend.orchestratorURL)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %w", err)
+// sanitizeAppName sanitizes the app name, falling back to "app" if nothing
+// usable remains.
+func sanitizeAppName(name string) string {
+	name = sanitizeIdentifier(name)
+	if name == "" {
+		name = "app"
 	}
+	return name
+}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.backend.jwtToken))
+// RecipientRoute is the app identifier and optional tag parsed from a
+// recipient address's local-part.
+type RecipientRoute struct {
+	AppName string
+	Tag     string
+}
 
-	// Send request
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send HTTP request: %w", err)
+// parseRecipientRoute extracts an app identifier and optional tag from the
+// local-part of a recipient address using delimiter to split the two, e.g.
+// "app+campaign@smtp.yundera.local" with delimiter "+" yields appName=app,
+// tag=campaign. An empty delimiter disables tag splitting; the whole
+// local-part is then taken as the app identifier. Returns ok=false if no
+// usable app identifier remains after sanitization.
+func parseRecipientRoute(to, delimiter string) (route RecipientRoute, ok bool) {
+	localPart := to
+	if at := strings.LastIndex(to, "@"); at >= 0 {
+		localPart = to[:at]
 	}
-	defer resp.Body.Close()
 
-	// Check response
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API returned error status %d: %s", resp.StatusCode, string(body))
+	appPart := localPart
+	if delimiter != "" {
+		if idx := strings.Index(localPart, delimiter); idx >= 0 {
+			appPart = localPart[:idx]
+			route.Tag = sanitizeIdentifier(localPart[idx+len(delimiter):])
+		}
 	}
 
-	log.Printf("Email successfully forwarded to API for recipient %s", recipientEmail)
-	return nil
-}
-
-// sanitizeAppName sanitizes the app name
-func sanitizeAppName(name string) string {
-	// Only allow alphanumeric and hyphens, lowercase, max 20 chars
-	reg := regexp.MustCompile("[^a-z0-9-]")
-	name = strings.ToLower(name)
-	name = reg.ReplaceAllString(name, "")
-	if len(name) > 20 {
-		name = name[:20]
-	}
-	if name == "" {
-		name = "app"
+	route.AppName = sanitizeIdentifier(appPart)
+	if route.AppName == "" {
+		return RecipientRoute{}, false
 	}
-	return name
+	return route, true
 }
 
-// parseEmail extracts subject, text, and HTML from email data using go-message library
-func parseEmail(data string) (subject, text, html string) {
+// parseEmail extracts subject, text, HTML and attachments from email data
+// using the go-message library. maxAttachmentSize and maxTotalAttachmentSize
+// bound how much attachment data is collected; anything beyond them is
+// skipped and logged rather than failing the parse.
+func parseEmail(data string, maxAttachmentSize, maxTotalAttachmentSize int64) (subject, text, html string, attachments []Attachment, parseFailed bool) {
 	reader := strings.NewReader(data)
 	entity, err := message.Read(reader)
 	if err != nil {
 		log.Printf("Failed to parse email: %v", err)
-		return "No Subject", data, ""
+		return "No Subject", data, "", nil, true
 	}
 
 	header := entity.Header
@@ -228,17 +363,59 @@ func parseEmail(data string) (subject, text, html string) {
 		subject = "No Subject"
 	}
 
-	text, html = extractBodyParts(entity)
+	collector := &attachmentCollector{
+		maxPerAttachment: maxAttachmentSize,
+		maxTotal:         maxTotalAttachmentSize,
+	}
+	text, html = extractBodyParts(entity, collector)
 
 	if text == "" && html != "" {
 		text = html
 	}
 
-	return subject, strings.TrimSpace(text), strings.TrimSpace(html)
+	return subject, strings.TrimSpace(text), strings.TrimSpace(html), collector.attachments, false
+}
+
+// attachmentCollector accumulates attachment parts while enforcing
+// per-attachment and total-size caps, so a malicious or oversized multipart
+// stream can't be used to exhaust memory.
+type attachmentCollector struct {
+	maxPerAttachment int64
+	maxTotal         int64
+	total            int64
+	attachments      []Attachment
+}
+
+// add reads an attachment part's body (bounded by maxPerAttachment) and
+// appends it to the collector, skipping and logging it if it would exceed
+// the per-attachment or total-size caps.
+func (c *attachmentCollector) add(filename, contentType string, body io.Reader) {
+	data, err := io.ReadAll(io.LimitReader(body, c.maxPerAttachment+1))
+	if err != nil {
+		log.Printf("Failed to read attachment %q: %v", filename, err)
+		return
+	}
+	size := int64(len(data))
+	if size > c.maxPerAttachment {
+		log.Printf("Skipping attachment %q: exceeds per-attachment limit of %d bytes", filename, c.maxPerAttachment)
+		return
+	}
+	if c.total+size > c.maxTotal {
+		log.Printf("Skipping attachment %q: total attachment size would exceed limit of %d bytes", filename, c.maxTotal)
+		return
+	}
+	c.total += size
+	c.attachments = append(c.attachments, Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Content:     base64.StdEncoding.EncodeToString(data),
+		Size:        int(size),
+	})
 }
 
-// extractBodyParts recursively extracts text and HTML parts from a MIME message
-func extractBodyParts(entity *message.Entity) (text, html string) {
+// extractBodyParts recursively extracts text and HTML parts from a MIME
+// message, collecting any attachment parts it encounters along the way.
+func extractBodyParts(entity *message.Entity, collector *attachmentCollector) (text, html string) {
 	mediaType, params, err := entity.Header.ContentType()
 	if err != nil {
 		body, _ := io.ReadAll(entity.Body)
@@ -265,7 +442,7 @@ func extractBodyParts(entity *message.Entity) (text, html string) {
 
 			partMediaType, _, _ := part.Header.ContentType()
 			contentID := part.Header.Get("Content-Id")
-			contentDisposition := part.Header.Get("Content-Disposition")
+			disposition, dispParams, _ := part.Header.ContentDisposition()
 
 			if strings.HasPrefix(partMediaType, "image/") && contentID != "" {
 				contentID = strings.Trim(contentID, "<>")
@@ -274,8 +451,10 @@ func extractBodyParts(entity *message.Entity) (text, html string) {
 					dataURI := fmt.Sprintf("data:%s;base64,%s", partMediaType, base64.StdEncoding.EncodeToString(body))
 					inlineImages[contentID] = dataURI
 				}
-			} else if contentDisposition == "" || !strings.HasPrefix(contentDisposition, "attachment") {
-				partText, partHTML := extractBodyParts(part)
+			} else if strings.EqualFold(disposition, "attachment") {
+				collector.add(attachmentFilename(dispParams, params), partMediaType, part.Body)
+			} else {
+				partText, partHTML := extractBodyParts(part, collector)
 				if partText != "" && text == "" {
 					text = partText
 				}
@@ -314,24 +493,53 @@ func extractBodyParts(entity *message.Entity) (text, html string) {
 	return text, html
 }
 
-// StartSMTPServer starts the SMTP server
-func StartSMTPServer(port, orchestratorURL, jwtToken string) error {
-	if port == "" {
-		return errors.New("SMTP port is required")
+// attachmentFilename picks the attachment's filename from the
+// Content-Disposition "filename" param, falling back to the Content-Type
+// "name" param, and finally a generic placeholder.
+func attachmentFilename(dispParams, typeParams map[string]string) string {
+	if name := dispParams["filename"]; name != "" {
+		return name
+	}
+	if name := typeParams["name"]; name != "" {
+		return name
 	}
+	return "attachment"
+}
 
-	if orchestratorURL == "" {
-		return errors.New("orchestrator URL is required")
+// StartSMTPServer starts the SMTP server and returns its backend so the
+// caller can drive a graceful shutdown of the outbound queue.
+func StartSMTPServer(cfg Config) (*SMTPBackend, error) {
+	if cfg.SMTPPort == "" {
+		return nil, errors.New("SMTP port is required")
 	}
 
-	if jwtToken == "" {
-		return errors.New("JWT token is required")
+	if cfg.OrchestratorURL == "" {
+		return nil, errors.New("orchestrator URL is required")
 	}
 
-	backend := NewSMTPBackend(orchestratorURL, jwtToken)
+	if cfg.JWTToken == "" {
+		return nil, errors.New("JWT token is required")
+	}
+
+	if cfg.MaxAttachmentSize <= 0 {
+		cfg.MaxAttachmentSize = DefaultMaxAttachmentSize
+	}
+
+	if cfg.MaxTotalAttachmentSize <= 0 {
+		cfg.MaxTotalAttachmentSize = DefaultMaxTotalAttachmentSize
+	}
+
+	if cfg.QueueDir == "" {
+		cfg.QueueDir = DefaultQueueDir
+	}
+
+	backend, err := NewSMTPBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	server := smtp.NewServer(backend)
-	server.Addr = ":" + port
+	server.Addr = ":" + cfg.SMTPPort
 	server.Domain = "smtp.yundera.local"
 	server.AllowInsecureAuth = true // OK within private Docker network
 	server.MaxMessageBytes = MaxEmailSize
@@ -339,33 +547,61 @@ func StartSMTPServer(port, orchestratorURL, jwtToken string) error {
 	server.ReadTimeout = 30 * time.Second
 	server.WriteTimeout = 30 * time.Second
 
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("TLS cert and key files must both be set, or neither")
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.AllowInsecureAuth = false // credentials must not cross the wire in plaintext once TLS is available
+	}
+
 	// Check if port is already in use
-	testLn, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	testLn, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.SMTPPort))
 	if err != nil {
-		return fmt.Errorf("port %s is already in use or cannot bind: %w", port, err)
+		return nil, fmt.Errorf("port %s is already in use or cannot bind: %w", cfg.SMTPPort, err)
 	}
 	testLn.Close()
 
 	// Listen on all interfaces (Docker network)
 	ln, err := net.Listen("tcp", server.Addr)
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %s: %w", port, err)
+		return nil, fmt.Errorf("failed to listen on port %s: %w", cfg.SMTPPort, err)
 	}
 
-	log.Printf("✓ SMTP Server started on port %s", port)
-	log.Printf("✓ Forwarding emails to Yundera orchestrator at %s", orchestratorURL)
+	log.Printf("✓ SMTP Server started on port %s", cfg.SMTPPort)
+	log.Printf("✓ Forwarding emails to Yundera orchestrator at %s", cfg.OrchestratorURL)
 	log.Printf("✓ Ready to accept SMTP connections from apps")
 
 	// Start serving in a goroutine
 	go func() {
-		if err := server.Serve(ln); err != nil {
+		if err := server.Serve(&countingListener{Listener: ln, metrics: backend.metrics}); err != nil {
 			log.Printf("SMTP server error: %v", err)
 		}
 	}()
 
+	if cfg.SMTPSPort != "" {
+		if server.TLSConfig == nil {
+			return nil, errors.New("SMTPS_PORT requires TLS_CERT_FILE/TLS_KEY_FILE to be set")
+		}
+		tlsLn, err := tls.Listen("tcp", ":"+cfg.SMTPSPort, server.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on SMTPS port %s: %w", cfg.SMTPSPort, err)
+		}
+		log.Printf("✓ SMTP Server started on implicit-TLS port %s", cfg.SMTPSPort)
+		go func() {
+			if err := server.Serve(&countingListener{Listener: tlsLn, metrics: backend.metrics}); err != nil {
+				log.Printf("SMTPS server error: %v", err)
+			}
+		}()
+	}
+
 	// Give it a moment to start
 	time.Sleep(100 * time.Millisecond)
 
 	log.Println("✓ SMTP server is running")
-	return nil
+	return backend, nil
 }
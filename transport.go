@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// Transport delivers a parsed EmailRequest, along with the original raw MIME
+// message it was parsed from, to some destination.
+type Transport interface {
+	Send(ctx context.Context, req EmailRequest, rawMIME []byte) error
+}
+
+// BuildTransport parses rawURL and returns the Transport it describes:
+// https:// or http:// for the Yundera orchestrator API (using jwtToken for
+// auth), smtp:// or smtps:// for a conventional SMTP relay, and
+// exec://<command> [args...] to pipe the raw MIME to a local MTA.
+func BuildTransport(rawURL, jwtToken string) (Transport, error) {
+	if spec, ok := strings.CutPrefix(rawURL, "exec://"); ok {
+		return newExecTransport(spec)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport URL %q: %w", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "https", "http":
+		return &httpTransport{url: rawURL, jwtToken: jwtToken}, nil
+	case "smtp", "smtps":
+		return newSMTPTransport(u)
+	default:
+		return nil, fmt.Errorf("unsupported transport scheme %q", u.Scheme)
+	}
+}
+
+// FallbackTransport tries each transport in order, returning nil as soon as
+// one succeeds. If all fail, it returns a combined error.
+type FallbackTransport struct {
+	transports []Transport
+}
+
+// Send implements Transport.
+func (f *FallbackTransport) Send(ctx context.Context, req EmailRequest, rawMIME []byte) error {
+	var errs []error
+	for _, t := range f.transports {
+		err := t.Send(ctx, req, rawMIME)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("all transports failed: %w", errors.Join(errs...))
+}
+
+// httpTransport posts the parsed EmailRequest as JSON to the Yundera
+// orchestrator API, the handler's original (and still default) transport.
+type httpTransport struct {
+	url      string
+	jwtToken string
+}
+
+// Send implements Transport.
+func (t *httpTransport) Send(ctx context.Context, req EmailRequest, _ []byte) error {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal email request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/email/send", t.url), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.jwtToken))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("API returned error status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// smtpTransport relays the raw MIME message to a conventional SMTP server.
+type smtpTransport struct {
+	addr        string
+	implicitTLS bool
+	username    string
+	password    string
+	authMech    string
+}
+
+// newSMTPTransport builds a smtpTransport from a smtp[s]://[user:pass@]host[:port][?auth=plain|login|cram-md5|xoauth2] URL.
+func newSMTPTransport(u *url.URL) (*smtpTransport, error) {
+	addr := u.Host
+	if !strings.Contains(addr, ":") {
+		if u.Scheme == "smtps" {
+			addr += ":465"
+		} else {
+			addr += ":587"
+		}
+	}
+
+	t := &smtpTransport{
+		addr:        addr,
+		implicitTLS: u.Scheme == "smtps",
+		authMech:    strings.ToLower(u.Query().Get("auth")),
+	}
+	if u.User != nil {
+		t.username = u.User.Username()
+		t.password, _ = u.User.Password()
+	}
+	return t, nil
+}
+
+// Send implements Transport.
+func (t *smtpTransport) Send(ctx context.Context, req EmailRequest, rawMIME []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	host := t.addr
+	if h, _, err := net.SplitHostPort(t.addr); err == nil {
+		host = h
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	var c *smtp.Client
+	var err error
+	if t.implicitTLS {
+		c, err = smtp.DialTLS(t.addr, tlsConfig)
+	} else {
+		c, err = smtp.DialStartTLS(t.addr, tlsConfig)
+	}
+	if err != nil {
+		return fmt.Errorf("smtp relay: failed to connect to %s: %w", t.addr, err)
+	}
+	defer c.Close()
+
+	if t.username != "" {
+		if err := c.Auth(t.authClient()); err != nil {
+			return fmt.Errorf("smtp relay: authentication failed: %w", err)
+		}
+	}
+
+	from := req.From
+	if from == "" {
+		from = "noreply@smtp.yundera.local"
+	}
+	if err := c.Mail(from, nil); err != nil {
+		return fmt.Errorf("smtp relay: MAIL FROM failed: %w", err)
+	}
+	if err := c.Rcpt(req.To, nil); err != nil {
+		return fmt.Errorf("smtp relay: RCPT TO failed: %w", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp relay: DATA failed: %w", err)
+	}
+	if _, err := w.Write(rawMIME); err != nil {
+		w.Close()
+		return fmt.Errorf("smtp relay: failed to write message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp relay: failed to finalize message: %w", err)
+	}
+
+	return c.Quit()
+}
+
+// authClient builds the SASL client for t's configured auth mechanism,
+// defaulting to PLAIN.
+func (t *smtpTransport) authClient() sasl.Client {
+	switch t.authMech {
+	case "login":
+		return sasl.NewLoginClient(t.username, t.password)
+	case "cram-md5":
+		return &cramMD5Client{username: t.username, secret: t.password}
+	case "xoauth2":
+		return &xoauth2Client{username: t.username, token: t.password}
+	default:
+		return sasl.NewPlainClient("", t.username, t.password)
+	}
+}
+
+// cramMD5Client implements the CRAM-MD5 SASL mechanism (RFC 2195) as a
+// sasl.Client; go-sasl only ships a server-side helper for it.
+type cramMD5Client struct {
+	username string
+	secret   string
+}
+
+// Start implements sasl.Client.
+func (c *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return "CRAM-MD5", nil, nil
+}
+
+// Next implements sasl.Client.
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	d := hmac.New(md5.New, []byte(c.secret))
+	d.Write(challenge)
+	return []byte(fmt.Sprintf("%s %x", c.username, d.Sum(nil))), nil
+}
+
+// xoauth2Client implements Google's XOAUTH2 SASL mechanism as a sasl.Client.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+// Start implements sasl.Client.
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", c.username, c.token))
+	return "XOAUTH2", ir, nil
+}
+
+// Next implements sasl.Client.
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// execTransport pipes the raw MIME message to a local MTA over stdin, e.g.
+// "exec:///usr/sbin/sendmail -t".
+type execTransport struct {
+	command string
+	args    []string
+}
+
+// newExecTransport parses the command and arguments following "exec://".
+func newExecTransport(spec string) (*execTransport, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("exec transport: empty command")
+	}
+	return &execTransport{command: fields[0], args: fields[1:]}, nil
+}
+
+// Send implements Transport.
+func (t *execTransport) Send(ctx context.Context, _ EmailRequest, rawMIME []byte) error {
+	cmd := exec.CommandContext(ctx, t.command, t.args...)
+	cmd.Stdin = bytes.NewReader(rawMIME)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("exec transport: %s failed: %w (stderr: %s)", t.command, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}